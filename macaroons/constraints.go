@@ -3,6 +3,7 @@ package macaroons
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"google.golang.org/grpc/peer"
@@ -13,6 +14,16 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	// paymentAmountCondition is the name of the caveat condition that
+	// limits the amount a macaroon can be used to pay.
+	paymentAmountCondition = "payment_amount"
+)
+
+// paymentAmountKey is the context key under which the amount of the payment
+// that is being authorized is stored.
+type paymentAmountKey struct{}
+
 // Constraint type adds a layer of indirection over macaroon caveats.
 type Constraint func(*macaroon.Macaroon) error
 
@@ -33,6 +44,26 @@ func AddConstraints(mac *macaroon.Macaroon, cs ...Constraint) (*macaroon.Macaroo
 	return newMac, nil
 }
 
+// DecodeCaveats parses a serialized macaroon and returns the conditions of all
+// its first-party caveats in the order they were added. Third-party caveats
+// are skipped.
+func DecodeCaveats(macBytes []byte) ([]string, error) {
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	for _, caveat := range mac.Caveats() {
+		if len(caveat.VerificationId) != 0 {
+			continue
+		}
+		conditions = append(conditions, string(caveat.Id))
+	}
+
+	return conditions, nil
+}
+
 // Each *Constraint function is a functional option, which takes a pointer
 // to the macaroon and adds another restriction to it. For each *Constraint,
 // the corresponding *Checker is provided if not provided by default.
@@ -88,3 +119,55 @@ func IPLockChecker() (string, checkers.Func) {
 		return nil
 	}
 }
+
+// PaymentAmountConstraint limits the macaroon to authorizing payments of at
+// most the given amount in millisatoshis.
+func PaymentAmountConstraint(amtMsat uint64) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) error {
+		return AddPaymentAmountCaveat(mac, amtMsat)
+	}
+}
+
+// AddPaymentAmountCaveat adds a caveat to the macaroon that limits it to
+// authorizing payments of at most the given amount in millisatoshis.
+func AddPaymentAmountCaveat(mac *macaroon.Macaroon, amtMsat uint64) error {
+	caveat := checkers.Condition(
+		paymentAmountCondition, strconv.FormatUint(amtMsat, 10),
+	)
+	return mac.AddFirstPartyCaveat([]byte(caveat))
+}
+
+// ContextWithPaymentAmount returns a copy of the context that carries the
+// amount in millisatoshis of the payment the macaroon is checked for. This is
+// the amount the PaymentAmountChecker compares against the caveat.
+func ContextWithPaymentAmount(ctx context.Context,
+	amtMsat uint64) context.Context {
+
+	return context.WithValue(ctx, paymentAmountKey{}, amtMsat)
+}
+
+// PaymentAmountChecker accepts the amount of the attempted payment from the
+// validation context and compares it with the maximum amount locked in the
+// macaroon. It is of the `Checker` type.
+func PaymentAmountChecker() (string, checkers.Func) {
+	return paymentAmountCondition, func(ctx context.Context, cond,
+		arg string) error {
+
+		maxAmt, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid payment amount caveat")
+		}
+
+		amt, ok := ctx.Value(paymentAmountKey{}).(uint64)
+		if !ok {
+			return fmt.Errorf("macaroon is limited to payments, " +
+				"but no payment amount is given")
+		}
+
+		if amt > maxAmt {
+			return fmt.Errorf("payment of %d msat exceeds "+
+				"macaroon limit of %d msat", amt, maxAmt)
+		}
+		return nil
+	}
+}
@@ -2,6 +2,7 @@ package macaroons_test
 
 import (
 	"github.com/lightningnetwork/lnd/macaroons"
+	"golang.org/x/net/context"
 	"gopkg.in/macaroon.v2"
 	"strings"
 	"testing"
@@ -106,3 +107,76 @@ func TestIPLockBadIP(t *testing.T) {
 		t.Fatalf("IPLockConstraint with bad IP should fail.")
 	}
 }
+
+// TestDecodeCaveats tests that the first-party caveat conditions of a
+// serialized macaroon are returned in the order they were added.
+func TestDecodeCaveats(t *testing.T) {
+	testMacaroon := createDummyMacaroon(t)
+	constrainedMac, err := macaroons.AddConstraints(testMacaroon,
+		macaroons.IPLockConstraint("127.0.0.1"),
+		macaroons.TimeoutConstraint(3))
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	macBytes, err := constrainedMac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing macaroon: %v", err)
+	}
+
+	conditions, err := macaroons.DecodeCaveats(macBytes)
+	if err != nil {
+		t.Fatalf("Error decoding caveats: %v", err)
+	}
+	if len(conditions) != 2 {
+		t.Fatalf("Expected 2 caveats, got %d", len(conditions))
+	}
+	if conditions[0] != "ipaddr 127.0.0.1" {
+		t.Fatalf("Unexpected first caveat '%s'", conditions[0])
+	}
+	if !strings.HasPrefix(conditions[1], "time-before ") {
+		t.Fatalf("Unexpected second caveat '%s'", conditions[1])
+	}
+
+	_, err = macaroons.DecodeCaveats([]byte("not a macaroon"))
+	if err == nil {
+		t.Fatalf("Decoding an invalid macaroon should fail.")
+	}
+}
+
+// TestPaymentAmountCaveat tests that a payment amount caveat is added to a
+// macaroon and that the checker only accepts payments within the limit.
+func TestPaymentAmountCaveat(t *testing.T) {
+	testMacaroon := createDummyMacaroon(t)
+	err := macaroons.AddPaymentAmountCaveat(testMacaroon, 1000)
+	if err != nil {
+		t.Fatalf("Error adding payment amount caveat: %v", err)
+	}
+	caveat := string(testMacaroon.Caveats()[0].Id)
+	if caveat != "payment_amount 1000" {
+		t.Fatalf("Added caveat '%s' does not meet the expectations!",
+			caveat)
+	}
+
+	name, checker := macaroons.PaymentAmountChecker()
+	if name != "payment_amount" {
+		t.Fatalf("Unexpected checker name '%s'", name)
+	}
+
+	ctx := context.Background()
+	err = checker(macaroons.ContextWithPaymentAmount(ctx, 1000), name,
+		"1000")
+	if err != nil {
+		t.Fatalf("Payment within the limit should pass: %v", err)
+	}
+
+	err = checker(macaroons.ContextWithPaymentAmount(ctx, 1001), name,
+		"1000")
+	if err == nil {
+		t.Fatalf("Payment exceeding the limit should fail.")
+	}
+
+	err = checker(ctx, name, "1000")
+	if err == nil {
+		t.Fatalf("Check without a payment amount should fail.")
+	}
+}
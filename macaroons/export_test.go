@@ -0,0 +1,13 @@
+package macaroons
+
+import "time"
+
+// SetCloseTimeout changes the time Close waits for in-flight operations to
+// finish. The returned function restores the previous timeout.
+func SetCloseTimeout(timeout time.Duration) func() {
+	oldTimeout := closeTimeout
+	closeTimeout = timeout
+	return func() {
+		closeTimeout = oldTimeout
+	}
+}
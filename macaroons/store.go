@@ -1,9 +1,17 @@
 package macaroons
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -17,16 +25,30 @@ const (
 	RootKeyLen = 32
 )
 
+var (
+	// closeTimeout is the maximum time Close waits for in-flight
+	// operations to finish before giving up.
+	closeTimeout = 10 * time.Second
+)
+
 var (
 	// rootKeyBucketName is the name of the root key store bucket.
 	rootKeyBucketName = []byte("macrootkeys")
 
+	// rootKeyUsageBucketName is the name of the bucket that tracks how
+	// many times each root key has been handed out to mint a macaroon.
+	rootKeyUsageBucketName = []byte("macrootkeyusage")
+
 	// defaultRootKeyID is the ID of the default root key. The first is
-	// just 0, to emulate the memory storage that comes with bakery.
-	//
-	// TODO(aakselrod): Add support for key rotation.
+	// just 0, to emulate the memory storage that comes with bakery. Keys
+	// created by rotation use the following decimal numbers as their IDs.
 	defaultRootKeyID = []byte("0")
 
+	// currentRootKeyIDKey is the name of the database key that stores the
+	// ID of the root key new macaroons are minted with. If it isn't set,
+	// defaultRootKeyID is the current ID.
+	currentRootKeyIDKey = []byte("currentkeyid")
+
 	// encryptedKeyID is the name of the database key that stores the
 	// encryption key, encrypted with a salted + hashed password. The
 	// format is 32 bytes of salt, and the rest is encrypted key.
@@ -42,21 +64,115 @@ var (
 
 	// ErrPasswordRequired specifies that a nil password has been passed.
 	ErrPasswordRequired = fmt.Errorf("a non-nil password is required")
+
+	// ErrEncKeyCorrupt specifies that the stored encryption key
+	// parameters couldn't be parsed, which means the database is corrupt
+	// rather than the password being wrong.
+	ErrEncKeyCorrupt = fmt.Errorf("stored macaroon encryption key is " +
+		"corrupt")
+
+	// ErrDeletingActiveKey specifies that the root key new macaroons are
+	// minted with can't be deleted.
+	ErrDeletingActiveKey = fmt.Errorf("cannot delete the active root key")
+
+	// ErrPasswordMismatch specifies that the new password and its
+	// confirmation don't match.
+	ErrPasswordMismatch = fmt.Errorf("new password and confirmation " +
+		"don't match")
+
+	// ErrStoreClosed specifies that the store has already been closed.
+	ErrStoreClosed = fmt.Errorf("macaroon store is closed")
+
+	// ErrCloseTimeout specifies that the store couldn't be closed because
+	// in-flight operations didn't finish in time.
+	ErrCloseTimeout = fmt.Errorf("timed out waiting for in-flight " +
+		"macaroon store operations to finish")
 )
 
 // RootKeyStorage implements the bakery.RootKeyStorage interface.
 type RootKeyStorage struct {
 	*bolt.DB
 
-	encKey *snacl.SecretKey
+	// encKey is the key used to encrypt and decrypt the root keys. It is
+	// guarded by encKeyMtx, which is held for reading for the duration of
+	// every transaction that uses it, so the key can't be swapped out
+	// while ciphertext read under the old key is being decrypted.
+	encKey    *snacl.SecretKey
+	encKeyMtx sync.RWMutex
+
+	// closed is set once Close has been called. After that, no new
+	// operations are allowed to start. It is guarded by opMtx.
+	closed bool
+	opMtx  sync.Mutex
+
+	// ops tracks the number of in-flight database operations so that
+	// Close can wait for them to finish.
+	ops sync.WaitGroup
+
+	// closeDone is closed once the in-flight operations have finished
+	// after Close was called, the encryption key was zeroed and the
+	// database was closed. closeErr holds the result of closing the
+	// database and must only be read after closeDone has been closed.
+	// closeDone is created by the first call to Close, guarded by opMtx.
+	closeDone chan struct{}
+	closeErr  error
+
+	// rootKeyCache holds decrypted root keys by ID, so that they don't
+	// have to be read from the database and decrypted on every call. It
+	// is guarded by cacheMtx.
+	rootKeyCache map[string][]byte
+	cacheMtx     sync.Mutex
+
+	// cacheGen is incremented every time the cache is cleared. A key read
+	// from the database is only added to the cache if the generation
+	// hasn't changed since before the read, so a key that was deleted in
+	// the meantime can't end up back in the cache. It is guarded by
+	// cacheMtx.
+	cacheGen uint64
+}
+
+// ScryptParams holds the parameters of the scrypt key derivation that turns
+// the password into the encryption key of the store.
+type ScryptParams struct {
+	// N is the CPU/memory cost parameter. It must be a power of two
+	// greater than one.
+	N int
+
+	// R is the block size parameter.
+	R int
+
+	// P is the parallelization parameter.
+	P int
+}
+
+// DefaultScryptParams are the scrypt parameters used by CreateUnlock.
+var DefaultScryptParams = ScryptParams{
+	N: snacl.DefaultN,
+	R: snacl.DefaultR,
+	P: snacl.DefaultP,
+}
+
+// RootKeyInfo holds informational metadata about a stored root key.
+type RootKeyInfo struct {
+	// ID is the ID of the root key.
+	ID []byte
+
+	// UsageCount is the number of times the root key has been handed out
+	// by RootKey to mint a new macaroon.
+	UsageCount uint64
 }
 
 // NewRootKeyStorage creates a RootKeyStorage instance.
 // TODO(aakselrod): Add support for encryption of data with passphrase.
 func NewRootKeyStorage(db *bolt.DB) (*RootKeyStorage, error) {
-	// If the store's bucket doesn't exist, create it.
+	// If the store's buckets don't exist, create them.
 	err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(rootKeyBucketName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(rootKeyUsageBucketName)
 		return err
 	})
 	if err != nil {
@@ -64,12 +180,140 @@ func NewRootKeyStorage(db *bolt.DB) (*RootKeyStorage, error) {
 	}
 
 	// Return the DB wrapped in a RootKeyStorage object.
-	return &RootKeyStorage{db, nil}, nil
+	return &RootKeyStorage{
+		DB:           db,
+		rootKeyCache: make(map[string][]byte),
+	}, nil
+}
+
+// cachedRootKey returns a copy of the cached root key with the given ID, if
+// it is in the cache. The current cache generation is returned as well, to be
+// passed to cacheRootKey on a miss.
+func (r *RootKeyStorage) cachedRootKey(id []byte) ([]byte, uint64, bool) {
+	r.cacheMtx.Lock()
+	defer r.cacheMtx.Unlock()
+
+	cachedKey, ok := r.rootKeyCache[string(id)]
+	if !ok {
+		return nil, r.cacheGen, false
+	}
+
+	rootKey := make([]byte, len(cachedKey))
+	copy(rootKey, cachedKey)
+	return rootKey, r.cacheGen, true
+}
+
+// cacheRootKey adds a copy of the given decrypted root key to the cache,
+// unless the cache has been cleared since generation gen was obtained from
+// cachedRootKey.
+func (r *RootKeyStorage) cacheRootKey(id, rootKey []byte, gen uint64) {
+	r.cacheMtx.Lock()
+	defer r.cacheMtx.Unlock()
+
+	if gen != r.cacheGen {
+		return
+	}
+
+	cachedKey := make([]byte, len(rootKey))
+	copy(cachedKey, rootKey)
+	r.rootKeyCache[string(id)] = cachedKey
+}
+
+// clearCache zeroes and removes all cached root keys and starts a new cache
+// generation.
+func (r *RootKeyStorage) clearCache() {
+	r.cacheMtx.Lock()
+	defer r.cacheMtx.Unlock()
+
+	r.cacheGen++
+
+	for id, cachedKey := range r.rootKeyCache {
+		zero(cachedKey)
+		delete(r.rootKeyCache, id)
+	}
+}
+
+// zero overwrites the given buffer with zeroes. It is used to clear transient
+// copies of sensitive key material before they go out of scope.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// beginOp registers a new in-flight operation. It returns ErrStoreClosed if
+// the store has already been closed. Every successful call must be paired
+// with a call to endOp.
+func (r *RootKeyStorage) beginOp() error {
+	r.opMtx.Lock()
+	defer r.opMtx.Unlock()
+
+	if r.closed {
+		return ErrStoreClosed
+	}
+
+	r.ops.Add(1)
+	return nil
+}
+
+// isClosed returns true if Close has been called on the store.
+func (r *RootKeyStorage) isClosed() bool {
+	r.opMtx.Lock()
+	defer r.opMtx.Unlock()
+
+	return r.closed
+}
+
+// endOp marks an in-flight operation as finished.
+func (r *RootKeyStorage) endOp() {
+	r.ops.Done()
+}
+
+// update executes the passed function within a read-write transaction of the
+// underlying database, tracking it as an in-flight operation.
+func (r *RootKeyStorage) update(fn func(tx *bolt.Tx) error) error {
+	if err := r.beginOp(); err != nil {
+		return err
+	}
+	defer r.endOp()
+
+	return r.DB.Update(fn)
+}
+
+// view executes the passed function within a read-only transaction of the
+// underlying database, tracking it as an in-flight operation.
+func (r *RootKeyStorage) view(fn func(tx *bolt.Tx) error) error {
+	if err := r.beginOp(); err != nil {
+		return err
+	}
+	defer r.endOp()
+
+	return r.DB.View(fn)
 }
 
 // CreateUnlock sets an encryption key if one is not already set, otherwise it
-// checks if the password is correct for the stored encryption key.
+// checks if the password is correct for the stored encryption key. A new
+// encryption key is derived using DefaultScryptParams.
 func (r *RootKeyStorage) CreateUnlock(password *[]byte) error {
+	return r.CreateUnlockWithParams(password, DefaultScryptParams)
+}
+
+// CreateUnlockWithParams works like CreateUnlock, but derives a new encryption
+// key with the given scrypt parameters. The parameters are stored along with
+// the encryption key, so they're only used when creating the key. Unlocking
+// an existing store always uses the stored parameters, so it can be done with
+// a plain CreateUnlock later on.
+func (r *RootKeyStorage) CreateUnlockWithParams(password *[]byte,
+	params ScryptParams) error {
+
+	// Check if the store has already been closed; return an error if so.
+	if r.isClosed() {
+		return ErrStoreClosed
+	}
+
+	r.encKeyMtx.Lock()
+	defer r.encKeyMtx.Unlock()
+
 	// Check if we've already unlocked the store; return an error if so.
 	if r.encKey != nil {
 		return ErrAlreadyUnlocked
@@ -80,19 +324,13 @@ func (r *RootKeyStorage) CreateUnlock(password *[]byte) error {
 		return ErrPasswordRequired
 	}
 
-	return r.Update(func(tx *bolt.Tx) error {
+	return r.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(rootKeyBucketName)
 		dbKey := bucket.Get(encryptedKeyID)
 		if len(dbKey) > 0 {
 			// We've already stored a key, so try to unlock with
 			// the password.
-			encKey := &snacl.SecretKey{}
-			err := encKey.Unmarshal(dbKey)
-			if err != nil {
-				return err
-			}
-
-			err = encKey.DeriveKey(password)
+			encKey, err := deriveEncKey(dbKey, password)
 			if err != nil {
 				return err
 			}
@@ -102,8 +340,8 @@ func (r *RootKeyStorage) CreateUnlock(password *[]byte) error {
 		}
 
 		// We haven't yet stored a key, so create a new one.
-		encKey, err := snacl.NewSecretKey(password, snacl.DefaultN,
-			snacl.DefaultR, snacl.DefaultP)
+		encKey, err := snacl.NewSecretKey(password, params.N,
+			params.R, params.P)
 		if err != nil {
 			return err
 		}
@@ -118,13 +356,176 @@ func (r *RootKeyStorage) CreateUnlock(password *[]byte) error {
 	})
 }
 
+// ChangePassword re-encrypts all root keys, including the ones that were
+// rotated out, with an encryption key derived from the new password. The
+// store must be unlocked and oldPw must match the stored encryption key. The
+// scrypt parameters of the current encryption key are kept.
+func (r *RootKeyStorage) ChangePassword(oldPw, newPw *[]byte) error {
+	if r.isClosed() {
+		return ErrStoreClosed
+	}
+
+	r.encKeyMtx.RLock()
+	locked := r.encKey == nil
+	r.encKeyMtx.RUnlock()
+	if locked {
+		return ErrStoreLocked
+	}
+	if oldPw == nil || newPw == nil {
+		return ErrPasswordRequired
+	}
+
+	// Derive both encryption keys up front, so the expensive scrypt runs
+	// don't block concurrent macaroon verification.
+	var dbKey []byte
+	err := r.view(func(tx *bolt.Tx) error {
+		storedKey := tx.Bucket(rootKeyBucketName).Get(encryptedKeyID)
+		dbKey = make([]byte, len(storedKey))
+		copy(dbKey, storedKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encKeyOld, err := deriveEncKey(dbKey, oldPw)
+	if err != nil {
+		return err
+	}
+	defer encKeyOld.Zero()
+
+	params := encKeyOld.Parameters
+	encKeyNew, err := snacl.NewSecretKey(
+		newPw, params.N, params.R, params.P,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Re-encrypting the root keys and swapping the in-memory encryption
+	// key must appear atomic to readers, so nobody decrypts with the old
+	// key what has already been re-encrypted with the new one.
+	r.encKeyMtx.Lock()
+	defer r.encKeyMtx.Unlock()
+
+	err = r.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rootKeyBucketName)
+
+		// If the password was changed in the meantime, oldPw no
+		// longer matches the stored encryption key.
+		if !bytes.Equal(bucket.Get(encryptedKeyID), dbKey) {
+			return snacl.ErrInvalidPassword
+		}
+
+		// Decrypt every root key with the old encryption key first,
+		// as the bucket can't be modified while iterating over it.
+		rootKeys := make(map[string][]byte)
+		defer func() {
+			for _, rootKey := range rootKeys {
+				zero(rootKey)
+			}
+		}()
+		err := bucket.ForEach(func(k, v []byte) error {
+			if !isRootKeyID(k) {
+				return nil
+			}
+
+			decKey, err := encKeyOld.Decrypt(v)
+			if err != nil {
+				return err
+			}
+			rootKeys[string(k)] = decKey
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for id, rootKey := range rootKeys {
+			encKey, err := encKeyNew.Encrypt(rootKey)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(id), encKey); err != nil {
+				return err
+			}
+		}
+
+		return bucket.Put(encryptedKeyID, encKeyNew.Marshal())
+	})
+	if err != nil {
+		encKeyNew.Zero()
+		return err
+	}
+
+	// Only switch to the new encryption key once the transaction has been
+	// committed successfully.
+	r.clearCache()
+	r.encKey.Zero()
+	r.encKey = encKeyNew
+	return nil
+}
+
+// ChangePasswordConfirmed works like ChangePassword, but takes the new
+// password twice, for example as entered in two separate prompts. If the two
+// don't match, ErrPasswordMismatch is returned before anything is changed.
+func (r *RootKeyStorage) ChangePasswordConfirmed(oldPw, newPw,
+	newPwConfirm *[]byte) error {
+
+	if r.isClosed() {
+		return ErrStoreClosed
+	}
+	if newPw == nil || newPwConfirm == nil {
+		return ErrPasswordRequired
+	}
+	if !bytes.Equal(*newPw, *newPwConfirm) {
+		return ErrPasswordMismatch
+	}
+
+	return r.ChangePassword(oldPw, newPw)
+}
+
+// deriveEncKey parses the stored encryption key parameters and derives the
+// encryption key from the given password. If the stored parameters can't be
+// used, ErrEncKeyCorrupt is returned, while a wrong password results in
+// snacl.ErrInvalidPassword.
+func deriveEncKey(dbKey []byte, password *[]byte) (*snacl.SecretKey, error) {
+	encKey := &snacl.SecretKey{}
+	if err := encKey.Unmarshal(dbKey); err != nil {
+		return nil, ErrEncKeyCorrupt
+	}
+
+	// A digest mismatch is reported as an invalid password. Any other
+	// error stems from bogus scrypt parameters read from the database.
+	err := encKey.DeriveKey(password)
+	switch {
+	case err == snacl.ErrInvalidPassword:
+		return nil, err
+
+	case err != nil:
+		return nil, ErrEncKeyCorrupt
+	}
+
+	return encKey, nil
+}
+
 // Get implements the Get method for the bakery.RootKeyStorage interface.
 func (r *RootKeyStorage) Get(_ context.Context, id []byte) ([]byte, error) {
+	if r.isClosed() {
+		return nil, ErrStoreClosed
+	}
+
+	r.encKeyMtx.RLock()
+	defer r.encKeyMtx.RUnlock()
+
 	if r.encKey == nil {
 		return nil, ErrStoreLocked
 	}
-	var rootKey []byte
-	err := r.View(func(tx *bolt.Tx) error {
+	rootKey, gen, ok := r.cachedRootKey(id)
+	if ok {
+		return rootKey, nil
+	}
+	err := r.view(func(tx *bolt.Tx) error {
 		dbKey := tx.Bucket(rootKeyBucketName).Get(id)
 		if len(dbKey) == 0 {
 			return fmt.Errorf("root key with id %s doesn't exist",
@@ -135,6 +536,7 @@ func (r *RootKeyStorage) Get(_ context.Context, id []byte) ([]byte, error) {
 		if err != nil {
 			return err
 		}
+		defer zero(decKey)
 
 		rootKey = make([]byte, len(decKey))
 		copy(rootKey[:], decKey)
@@ -144,60 +546,481 @@ func (r *RootKeyStorage) Get(_ context.Context, id []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	r.cacheRootKey(id, rootKey, gen)
 	return rootKey, nil
 }
 
 // RootKey implements the RootKey method for the bakery.RootKeyStorage
-// interface.
-// TODO(aakselrod): Add support for key rotation.
+// interface. It returns the current root key, creating it if necessary.
 func (r *RootKeyStorage) RootKey(_ context.Context) ([]byte, []byte, error) {
+	if r.isClosed() {
+		return nil, nil, ErrStoreClosed
+	}
+
+	r.encKeyMtx.RLock()
+	defer r.encKeyMtx.RUnlock()
+
 	if r.encKey == nil {
 		return nil, nil, ErrStoreLocked
 	}
-	var rootKey []byte
-	id := defaultRootKeyID
-	err := r.Update(func(tx *bolt.Tx) error {
+	var (
+		rootKey []byte
+		id      []byte
+		gen     uint64
+	)
+	err := r.update(func(tx *bolt.Tx) error {
 		ns := tx.Bucket(rootKeyBucketName)
-		dbKey := ns.Get(id)
+		id = currentRootKeyID(ns)
+
+		// If the current root key is cached, there's no need to
+		// decrypt it again. The cache generation is read within this
+		// write transaction, so no deletion can commit before the key
+		// is read below.
+		cachedKey, cacheGen, ok := r.cachedRootKey(id)
+		gen = cacheGen
+		if ok {
+			rootKey = cachedKey
+			return incrementKeyUsage(tx, id)
+		}
 
 		// If there's a root key stored in the bucket, decrypt it and
 		// return it.
+		dbKey := ns.Get(id)
 		if len(dbKey) != 0 {
 			decKey, err := r.encKey.Decrypt(dbKey)
 			if err != nil {
 				return err
 			}
+			defer zero(decKey)
 
 			rootKey = make([]byte, len(decKey))
 			copy(rootKey[:], decKey[:])
-			return nil
+			return incrementKeyUsage(tx, id)
 		}
 
-		// Otherwise, create a RootKeyLen-byte root key, encrypt it,
-		// and store it in the bucket.
-		rootKey = make([]byte, RootKeyLen)
-		if _, err := io.ReadFull(rand.Reader, rootKey[:]); err != nil {
+		// Otherwise, create a new root key and store it in the
+		// bucket.
+		var err error
+		rootKey, err = r.generateRootKey(ns, id)
+		if err != nil {
 			return err
 		}
 
-		encKey, err := r.encKey.Encrypt(rootKey)
+		return incrementKeyUsage(tx, id)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.cacheRootKey(id, rootKey, gen)
+	return rootKey, id, nil
+}
+
+// RotateRootKey creates a new root key under the next ID and makes it the
+// current one, so all macaroons minted from now on use the new key. Old keys
+// are kept, so Get can still resolve them to verify previously issued
+// macaroons. The ID of the new root key is returned.
+func (r *RootKeyStorage) RotateRootKey() ([]byte, error) {
+	if r.isClosed() {
+		return nil, ErrStoreClosed
+	}
+
+	r.encKeyMtx.RLock()
+	defer r.encKeyMtx.RUnlock()
+
+	if r.encKey == nil {
+		return nil, ErrStoreLocked
+	}
+	var newID []byte
+	err := r.update(func(tx *bolt.Tx) error {
+		ns := tx.Bucket(rootKeyBucketName)
+
+		currentID, err := strconv.ParseUint(
+			string(currentRootKeyID(ns)), 10, 64,
+		)
 		if err != nil {
+			return fmt.Errorf("invalid current root key id: %v",
+				err)
+		}
+		newID = []byte(strconv.FormatUint(currentID+1, 10))
+
+		if _, err := r.generateRootKey(ns, newID); err != nil {
 			return err
 		}
-		return ns.Put(id, encKey)
+
+		return ns.Put(currentRootKeyIDKey, newID)
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return rootKey, id, nil
+	r.clearCache()
+	return newID, nil
+}
+
+// ListRootKeyIDs returns the IDs of all root keys in the store, including the
+// ones that were rotated out. The store doesn't need to be unlocked.
+func (r *RootKeyStorage) ListRootKeyIDs() ([][]byte, error) {
+	var ids [][]byte
+	err := r.view(func(tx *bolt.Tx) error {
+		ns := tx.Bucket(rootKeyBucketName)
+		return ns.ForEach(func(k, _ []byte) error {
+			if !isRootKeyID(k) {
+				return nil
+			}
+
+			id := make([]byte, len(k))
+			copy(id, k)
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// DeleteRootKey removes the root key with the given ID from the store. All
+// macaroons minted with that key can no longer be verified, which makes this
+// the way to revoke them after the key has been rotated out. The currently
+// active root key can't be deleted.
+func (r *RootKeyStorage) DeleteRootKey(id []byte) error {
+	if r.isClosed() {
+		return ErrStoreClosed
+	}
+
+	r.encKeyMtx.RLock()
+	defer r.encKeyMtx.RUnlock()
+
+	if r.encKey == nil {
+		return ErrStoreLocked
+	}
+	if !isRootKeyID(id) {
+		return fmt.Errorf("%s is not a root key id", string(id))
+	}
+	err := r.update(func(tx *bolt.Tx) error {
+		ns := tx.Bucket(rootKeyBucketName)
+		if bytes.Equal(id, currentRootKeyID(ns)) {
+			return ErrDeletingActiveKey
+		}
+
+		if len(ns.Get(id)) == 0 {
+			return fmt.Errorf("root key with id %s doesn't exist",
+				string(id))
+		}
+		if err := ns.Delete(id); err != nil {
+			return err
+		}
+
+		return tx.Bucket(rootKeyUsageBucketName).Delete(id)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The deleted key must not be served from the cache anymore, or
+	// macaroons minted with it would still verify.
+	r.clearCache()
+	return nil
 }
 
-// Close closes the underlying database and zeroes the encryption key stored
-// in memory.
+// isRootKeyID returns false if the given database key in the root key bucket
+// is used for bookkeeping rather than for storing a root key.
+func isRootKeyID(id []byte) bool {
+	return !bytes.Equal(id, encryptedKeyID) &&
+		!bytes.Equal(id, currentRootKeyIDKey)
+}
+
+// currentRootKeyID returns a copy of the ID of the root key new macaroons are
+// minted with.
+func currentRootKeyID(ns *bolt.Bucket) []byte {
+	storedID := ns.Get(currentRootKeyIDKey)
+	if len(storedID) == 0 {
+		storedID = defaultRootKeyID
+	}
+
+	id := make([]byte, len(storedID))
+	copy(id, storedID)
+	return id
+}
+
+// generateRootKey creates a RootKeyLen-byte root key, encrypts it and stores
+// it in the bucket under the given ID. The plaintext key is returned. The
+// caller must hold encKeyMtx for reading.
+func (r *RootKeyStorage) generateRootKey(ns *bolt.Bucket,
+	id []byte) ([]byte, error) {
+
+	rootKey := make([]byte, RootKeyLen)
+	if _, err := io.ReadFull(rand.Reader, rootKey[:]); err != nil {
+		return nil, err
+	}
+
+	encKey, err := r.encKey.Encrypt(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := ns.Put(id, encKey); err != nil {
+		return nil, err
+	}
+
+	return rootKey, nil
+}
+
+// incrementKeyUsage increments the usage counter of the root key with the
+// given ID.
+func incrementKeyUsage(tx *bolt.Tx, id []byte) error {
+	usage := tx.Bucket(rootKeyUsageBucketName)
+
+	var count uint64
+	if countBytes := usage.Get(id); len(countBytes) == 8 {
+		count = binary.BigEndian.Uint64(countBytes)
+	}
+
+	var newCount [8]byte
+	binary.BigEndian.PutUint64(newCount[:], count+1)
+	return usage.Put(id, newCount[:])
+}
+
+// RootKeyInfo returns informational metadata, like the usage count, about the
+// root key with the given ID. Since no key material is involved, the store
+// doesn't need to be unlocked.
+func (r *RootKeyStorage) RootKeyInfo(id []byte) (*RootKeyInfo, error) {
+	info := &RootKeyInfo{
+		ID: make([]byte, len(id)),
+	}
+	copy(info.ID, id)
+
+	err := r.view(func(tx *bolt.Tx) error {
+		dbKey := tx.Bucket(rootKeyBucketName).Get(id)
+		if len(dbKey) == 0 || !isRootKeyID(id) {
+			return fmt.Errorf("root key with id %s doesn't exist",
+				string(id))
+		}
+
+		countBytes := tx.Bucket(rootKeyUsageBucketName).Get(id)
+		if len(countBytes) == 8 {
+			info.UsageCount = binary.BigEndian.Uint64(countBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ListRootKeyInfo returns informational metadata, like the usage count, about
+// all root keys in the store, including the ones that were rotated out. Like
+// RootKeyInfo, it doesn't need the store to be unlocked.
+func (r *RootKeyStorage) ListRootKeyInfo() ([]*RootKeyInfo, error) {
+	var infos []*RootKeyInfo
+	err := r.view(func(tx *bolt.Tx) error {
+		usage := tx.Bucket(rootKeyUsageBucketName)
+		ns := tx.Bucket(rootKeyBucketName)
+		return ns.ForEach(func(k, _ []byte) error {
+			if !isRootKeyID(k) {
+				return nil
+			}
+
+			info := &RootKeyInfo{
+				ID: make([]byte, len(k)),
+			}
+			copy(info.ID, k)
+
+			countBytes := usage.Get(k)
+			if len(countBytes) == 8 {
+				info.UsageCount = binary.BigEndian.Uint64(
+					countBytes,
+				)
+			}
+
+			infos = append(infos, info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// Backup writes a consistent snapshot of the entire database to the given
+// writer. The root keys stay encrypted with the store's password, so the
+// store doesn't need to be unlocked and the backup is safe at rest.
+func (r *RootKeyStorage) Backup(w io.Writer) error {
+	return r.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// RestoreFromReader writes a backup created by Backup to a new database file
+// at dbPath. The backup is first written to a temporary file and validated:
+// the root key bucket must exist and the stored encryption key parameters, if
+// any, must parse. Only then is it moved into place. An existing file at
+// dbPath is only overwritten if force is set.
+func RestoreFromReader(dbPath string, r io.Reader, force bool) error {
+	_, err := os.Stat(dbPath)
+	switch {
+	case err == nil && !force:
+		return fmt.Errorf("refusing to overwrite existing file %s",
+			dbPath)
+
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	// Write to a uniquely named temporary file next to dbPath, so it can
+	// be renamed into place without clobbering anything already there.
+	f, err := ioutil.TempFile(
+		filepath.Dir(dbPath), filepath.Base(dbPath)+".restore-",
+	)
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := validateBackup(tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, dbPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// RestoreFromBackup restores the backup file at backupPath, as written by
+// Backup, to a new database file at dbPath using RestoreFromReader, and opens
+// the restored copy as a root key store. The backup file itself is only read,
+// so it stays intact. An existing file at dbPath is never overwritten. The
+// returned store is locked and unlocks with the password that was in use when
+// the backup was taken.
+func RestoreFromBackup(backupPath, dbPath string) (*RootKeyStorage, error) {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	err = RestoreFromReader(dbPath, f, false)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(dbPath, 0600, bolt.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewRootKeyStorage(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// validateBackup opens the database at the given path read-only and makes
+// sure it looks like a usable root key store.
+func validateBackup(dbPath string) error {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to open backup: %v", err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rootKeyBucketName)
+		if bucket == nil {
+			return fmt.Errorf("backup is missing the %s bucket",
+				string(rootKeyBucketName))
+		}
+
+		// The root keys themselves can't be checked without the
+		// password, but the encryption key parameters can.
+		dbKey := bucket.Get(encryptedKeyID)
+		if len(dbKey) == 0 {
+			return nil
+		}
+		if err := (&snacl.SecretKey{}).Unmarshal(dbKey); err != nil {
+			return ErrEncKeyCorrupt
+		}
+
+		return nil
+	})
+}
+
+// Close closes the underlying database and zeroes the encryption key and all
+// cached root keys stored in memory. Any operation that is still in flight is
+// given up to closeTimeout to finish before the database is closed.
+// Operations started after Close has been called fail with ErrStoreClosed.
+//
+// If the in-flight operations don't finish in time, ErrCloseTimeout is
+// returned. The cached root keys are zeroed regardless, and the encryption
+// key is zeroed and the database closed in the background as soon as the
+// remaining operations finish. Close can be called again to wait for that.
 func (r *RootKeyStorage) Close() error {
+	r.opMtx.Lock()
+	if !r.closed {
+		r.closed = true
+		r.closeDone = make(chan struct{})
+
+		// No new operations can be registered at this point, so we
+		// only need to wait for the ones that are already running.
+		go r.finishClose()
+	}
+	done := r.closeDone
+	r.opMtx.Unlock()
+
+	// The cached root keys aren't needed by the in-flight operations, so
+	// they're zeroed right away.
+	r.clearCache()
+
+	select {
+	case <-done:
+		return r.closeErr
+	case <-time.After(closeTimeout):
+		return ErrCloseTimeout
+	}
+}
+
+// finishClose waits for all in-flight operations to finish, then zeroes the
+// encryption key and closes the underlying database. It must be run as a
+// goroutine exactly once, after the store has been marked as closed.
+func (r *RootKeyStorage) finishClose() {
+	r.ops.Wait()
+
+	r.clearCache()
+
+	r.encKeyMtx.Lock()
 	if r.encKey != nil {
 		r.encKey.Zero()
 	}
-	return r.DB.Close()
+	r.encKeyMtx.Unlock()
+
+	r.closeErr = r.DB.Close()
+	close(r.closeDone)
 }
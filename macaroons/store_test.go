@@ -2,16 +2,22 @@ package macaroons_test
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/coreos/bbolt"
 
 	"github.com/lightningnetwork/lnd/macaroons"
 
 	"github.com/btcsuite/btcwallet/snacl"
+
+	macaroon "gopkg.in/macaroon.v2"
 )
 
 func TestStore(t *testing.T) {
@@ -135,3 +141,1231 @@ func TestStore(t *testing.T) {
 			rootID, id)
 	}
 }
+
+// openTestStore opens the database at the given path and wraps it in a root
+// key store.
+func openTestStore(t testing.TB, dbPath string) *macaroons.RootKeyStorage {
+	db, err := bolt.Open(dbPath, 0600, bolt.DefaultOptions)
+	if err != nil {
+		t.Fatalf("Error opening store DB: %v", err)
+	}
+
+	store, err := macaroons.NewRootKeyStorage(db)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Error creating root key store: %v", err)
+	}
+
+	return store
+}
+
+// newTestStore creates a locked root key store backed by a database in a new
+// temporary directory. Besides the store, the directory and a function that
+// closes the store and removes the directory are returned.
+func newTestStore(t testing.TB) (*macaroons.RootKeyStorage, string, func()) {
+	tempDir, err := ioutil.TempDir("", "macaroonstore-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+
+	store := openTestStore(t, path.Join(tempDir, "weks.db"))
+	cleanup := func() {
+		store.Close()
+		os.RemoveAll(tempDir)
+	}
+
+	return store, tempDir, cleanup
+}
+
+// reopenStore closes the given store and opens its database in tempDir again.
+// The returned store is locked.
+func reopenStore(t testing.TB, store *macaroons.RootKeyStorage,
+	tempDir string) *macaroons.RootKeyStorage {
+
+	store.Close()
+	return openTestStore(t, path.Join(tempDir, "weks.db"))
+}
+
+// blockingWriter is an io.Writer that blocks on its first write until it is
+// released. It is used to hold a Backup in flight for as long as needed.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+// newBlockingWriter creates a new blockingWriter.
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+// Write signals that writing has started and blocks until the writer is
+// released.
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+	})
+	<-w.release
+	return len(p), nil
+}
+
+// startBlockedBackup unlocks the store, mints a macaroon root key and starts a
+// backup into the returned writer, which blocks until it is released. The
+// result of the backup is sent on the returned channel.
+func startBlockedBackup(t *testing.T,
+	store *macaroons.RootKeyStorage) (*blockingWriter, []byte, chan error) {
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	_, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	w := newBlockingWriter()
+	backupErr := make(chan error, 1)
+	go func() {
+		backupErr <- store.Backup(w)
+	}()
+	<-w.started
+
+	return w, id, backupErr
+}
+
+// TestStoreCloseWaitsForOperations tests that closing the store waits for
+// in-flight operations to finish and that no new operations can be started
+// once the store is closed.
+func TestStoreCloseWaitsForOperations(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	w, id, backupErr := startBlockedBackup(t, store)
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- store.Close()
+	}()
+
+	// The backup can't finish before the writer is released, so neither
+	// can Close.
+	select {
+	case err := <-closeErr:
+		t.Fatalf("Close returned while a backup was in flight: %v",
+			err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(w.release)
+	if err := <-backupErr; err != nil {
+		t.Fatalf("Error backing up store: %v", err)
+	}
+	if err := <-closeErr; err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+
+	_, _, err := store.RootKey(nil)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.Get(nil, id)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+}
+
+// TestStoreCloseTimeout tests that a Close that times out still refuses new
+// operations and that the store is fully closed once the in-flight operations
+// have finished.
+func TestStoreCloseTimeout(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	w, id, backupErr := startBlockedBackup(t, store)
+
+	restoreTimeout := macaroons.SetCloseTimeout(10 * time.Millisecond)
+	err := store.Close()
+	restoreTimeout()
+	if err != macaroons.ErrCloseTimeout {
+		t.Fatalf("Received %v instead of ErrCloseTimeout", err)
+	}
+
+	// The root key minted above must not be served from the cache.
+	_, err = store.Get(nil, id)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	close(w.release)
+	if err := <-backupErr; err != nil {
+		t.Fatalf("Error backing up store: %v", err)
+	}
+
+	// Calling Close again waits for the store to be fully closed.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+	err = store.DB.View(func(*bolt.Tx) error {
+		return nil
+	})
+	if err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("Received %v instead of ErrDatabaseNotOpen", err)
+	}
+}
+
+// TestStoreOperationsAfterClose tests that every operation on a closed store
+// consistently fails with ErrStoreClosed, regardless of the lock state the
+// store was in when it was closed.
+func TestStoreOperationsAfterClose(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+
+	// Without the closed check, an unlocked store would report
+	// ErrAlreadyUnlocked and a nil password ErrPasswordRequired.
+	err = store.CreateUnlock(&pw)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	err = store.CreateUnlock(nil)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, _, err = store.RootKey(nil)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.Get(nil, nil)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	err = store.Backup(ioutil.Discard)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	newPw := []byte("newweks")
+	err = store.ChangePassword(&pw, &newPw)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	// A mismatching confirmation or a nil password must not hide the
+	// fact that the store is closed.
+	typo := []byte("newwkes")
+	err = store.ChangePasswordConfirmed(&pw, &newPw, &typo)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	err = store.ChangePasswordConfirmed(&pw, nil, nil)
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.RotateRootKey()
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	err = store.DeleteRootKey([]byte("0"))
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.ListRootKeyIDs()
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.RootKeyInfo([]byte("0"))
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+
+	_, err = store.ListRootKeyInfo()
+	if err != macaroons.ErrStoreClosed {
+		t.Fatalf("Received %v instead of ErrStoreClosed", err)
+	}
+}
+
+// TestStoreCorruptEncKey tests that a stored encryption key that can't be
+// parsed is reported as ErrEncKeyCorrupt rather than as a wrong password.
+func TestStoreCorruptEncKey(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	// A wrong password on an intact key is reported as such.
+	store = reopenStore(t, store, tempDir)
+	defer store.Close()
+
+	badpw := []byte("badweks")
+	err = store.CreateUnlock(&badpw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+
+	// Now truncate the stored encryption key and make sure even the
+	// correct password results in ErrEncKeyCorrupt.
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("macrootkeys"))
+		encKey := bucket.Get([]byte("enckey"))
+		corrupt := make([]byte, len(encKey)/2)
+		copy(corrupt, encKey)
+		return bucket.Put([]byte("enckey"), corrupt)
+	})
+	if err != nil {
+		t.Fatalf("Error corrupting encryption key: %v", err)
+	}
+
+	err = store.CreateUnlock(&pw)
+	if err != macaroons.ErrEncKeyCorrupt {
+		t.Fatalf("Received %v instead of ErrEncKeyCorrupt", err)
+	}
+}
+
+// TestStoreBackup tests that a backup written by the store can be opened as
+// a new database that still holds the same, encrypted root key.
+func TestStoreBackup(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	key, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	var backup bytes.Buffer
+	if err := store.Backup(&backup); err != nil {
+		t.Fatalf("Error backing up store: %v", err)
+	}
+
+	backupPath := path.Join(tempDir, "backup.db")
+	err = ioutil.WriteFile(backupPath, backup.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("Error writing backup file: %v", err)
+	}
+
+	backupStore := openTestStore(t, backupPath)
+	defer backupStore.Close()
+
+	err = backupStore.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error unlocking backup store: %v", err)
+	}
+
+	key2, err := backupStore.Get(nil, id)
+	if err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(id), err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Fatalf("Root key doesn't match: expected %v, got %v",
+			key, key2)
+	}
+}
+
+// assertNoRestoreFiles makes sure no temporary files created by
+// RestoreFromReader are left in the given directory.
+func assertNoRestoreFiles(t *testing.T, dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), ".restore") {
+			t.Fatalf("Temporary file %s left behind", file.Name())
+		}
+	}
+}
+
+// TestRestoreFromReader tests that a backup restores into a working store and
+// that invalid backups or existing files are refused.
+func TestRestoreFromReader(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	key, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	var backup bytes.Buffer
+	if err := store.Backup(&backup); err != nil {
+		t.Fatalf("Error backing up store: %v", err)
+	}
+
+	// Garbage must not be accepted as a backup.
+	restorePath := path.Join(tempDir, "restored.db")
+	err = macaroons.RestoreFromReader(
+		restorePath, bytes.NewReader([]byte("garbage")), false,
+	)
+	if err == nil {
+		t.Fatalf("Restoring an invalid backup should fail.")
+	}
+	if _, err := os.Stat(restorePath); !os.IsNotExist(err) {
+		t.Fatalf("Invalid backup left a file behind: %v", err)
+	}
+	assertNoRestoreFiles(t, tempDir)
+
+	// An unrelated file that happens to use a temporary-looking name must
+	// not be touched.
+	stalePath := restorePath + ".restore"
+	err = ioutil.WriteFile(stalePath, []byte("stale"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing stale file: %v", err)
+	}
+
+	err = macaroons.RestoreFromReader(
+		restorePath, bytes.NewReader(backup.Bytes()), false,
+	)
+	if err != nil {
+		t.Fatalf("Error restoring backup: %v", err)
+	}
+
+	stale, err := ioutil.ReadFile(stalePath)
+	if err != nil {
+		t.Fatalf("Error reading stale file: %v", err)
+	}
+	if string(stale) != "stale" {
+		t.Fatalf("Restoring overwrote an existing file")
+	}
+	if err := os.Remove(stalePath); err != nil {
+		t.Fatalf("Error removing stale file: %v", err)
+	}
+	assertNoRestoreFiles(t, tempDir)
+
+	// If the backup can't be moved into place, as a non-empty directory
+	// can't be replaced by a file, the temporary file is removed too.
+	blockedPath := path.Join(tempDir, "blocked.db")
+	err = os.MkdirAll(path.Join(blockedPath, "dir"), 0700)
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	err = macaroons.RestoreFromReader(
+		blockedPath, bytes.NewReader(backup.Bytes()), true,
+	)
+	if err == nil {
+		t.Fatalf("Restoring over a non-empty directory should fail.")
+	}
+	assertNoRestoreFiles(t, tempDir)
+
+	// A second restore to the same path is only allowed when forced.
+	err = macaroons.RestoreFromReader(
+		restorePath, bytes.NewReader(backup.Bytes()), false,
+	)
+	if err == nil {
+		t.Fatalf("Restoring over an existing file should fail.")
+	}
+	err = macaroons.RestoreFromReader(
+		restorePath, bytes.NewReader(backup.Bytes()), true,
+	)
+	if err != nil {
+		t.Fatalf("Error restoring backup with force: %v", err)
+	}
+
+	restoredStore := openTestStore(t, restorePath)
+	defer restoredStore.Close()
+
+	err = restoredStore.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error unlocking restored store: %v", err)
+	}
+
+	key2, err := restoredStore.Get(nil, id)
+	if err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(id), err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Fatalf("Root key doesn't match: expected %v, got %v",
+			key, key2)
+	}
+}
+
+// TestRootKeyUsage tests that every macaroon minted with a root key is counted
+// in the key's info.
+func TestRootKeyUsage(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	// No root key has been created yet, and the encryption key must not
+	// be mistaken for one.
+	_, err = store.RootKeyInfo([]byte("0"))
+	if err == nil {
+		t.Fatalf("Expected error for non-existent root key")
+	}
+	_, err = store.RootKeyInfo([]byte("enckey"))
+	if err == nil {
+		t.Fatalf("Expected error for encryption key")
+	}
+
+	// Mint twice under the same key. Retrieving the key with Get for
+	// verification must not count as a use.
+	_, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	_, _, err = store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	_, err = store.Get(nil, id)
+	if err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(id), err)
+	}
+
+	info, err := store.RootKeyInfo(id)
+	if err != nil {
+		t.Fatalf("Error getting root key info: %v", err)
+	}
+	if !bytes.Equal(info.ID, id) {
+		t.Fatalf("Root ID doesn't match: expected %v, got %v",
+			id, info.ID)
+	}
+	if info.UsageCount != 2 {
+		t.Fatalf("Expected usage count of 2, got %d", info.UsageCount)
+	}
+}
+
+// TestListRootKeyInfo tests that all root keys are listed with their usage
+// counts, including a freshly rotated key that hasn't been used yet.
+func TestListRootKeyInfo(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	infos, err := store.ListRootKeyInfo()
+	if err != nil {
+		t.Fatalf("Error listing root key info: %v", err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("Expected no root key info, got %d", len(infos))
+	}
+
+	// Mint three macaroons under the initial key, then rotate.
+	var oldID []byte
+	for i := 0; i < 3; i++ {
+		_, oldID, err = store.RootKey(nil)
+		if err != nil {
+			t.Fatalf("Error getting root key from store: %v", err)
+		}
+	}
+	newID, err := store.RotateRootKey()
+	if err != nil {
+		t.Fatalf("Error rotating root key: %v", err)
+	}
+
+	infos, err = store.ListRootKeyInfo()
+	if err != nil {
+		t.Fatalf("Error listing root key info: %v", err)
+	}
+
+	expectedCounts := map[string]uint64{
+		string(oldID): 3,
+		string(newID): 0,
+	}
+	if len(infos) != len(expectedCounts) {
+		t.Fatalf("Expected %d root key infos, got %d",
+			len(expectedCounts), len(infos))
+	}
+	for _, info := range infos {
+		count, ok := expectedCounts[string(info.ID)]
+		if !ok {
+			t.Fatalf("Unexpected root key ID %s", string(info.ID))
+		}
+		if info.UsageCount != count {
+			t.Fatalf("Expected usage count of %d for root key %s, "+
+				"got %d", count, string(info.ID),
+				info.UsageCount)
+		}
+	}
+}
+
+// TestRotateRootKey tests that rotating the root key makes new macaroons use a
+// fresh key while old keys can still be retrieved.
+func TestRotateRootKey(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	_, err := store.RotateRootKey()
+	if err != macaroons.ErrStoreLocked {
+		t.Fatalf("Received %v instead of ErrStoreLocked", err)
+	}
+
+	pw := []byte("weks")
+	err = store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	oldKey, oldID, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	newID, err := store.RotateRootKey()
+	if err != nil {
+		t.Fatalf("Error rotating root key: %v", err)
+	}
+	if bytes.Equal(oldID, newID) {
+		t.Fatalf("Root ID didn't change on rotation: %s",
+			string(newID))
+	}
+
+	// The freshly created key hasn't been used to mint anything yet.
+	info, err := store.RootKeyInfo(newID)
+	if err != nil {
+		t.Fatalf("Error getting root key info: %v", err)
+	}
+	if info.UsageCount != 0 {
+		t.Fatalf("Expected usage count of 0, got %d", info.UsageCount)
+	}
+
+	// New macaroons are minted with the new key.
+	newKey, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	if !bytes.Equal(id, newID) {
+		t.Fatalf("Root ID doesn't match: expected %v, got %v",
+			newID, id)
+	}
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatalf("Root key didn't change on rotation")
+	}
+
+	// The old key is still available to verify old macaroons.
+	key, err := store.Get(nil, oldID)
+	if err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(oldID),
+			err)
+	}
+	if !bytes.Equal(key, oldKey) {
+		t.Fatalf("Root key doesn't match: expected %v, got %v",
+			oldKey, key)
+	}
+
+	// The current ID survives re-opening the store.
+	store = reopenStore(t, store, tempDir)
+	defer store.Close()
+
+	err = store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error unlocking root key store: %v", err)
+	}
+
+	key, id, err = store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	if !bytes.Equal(id, newID) || !bytes.Equal(key, newKey) {
+		t.Fatalf("Current root key not persisted")
+	}
+}
+
+// TestListRootKeyIDs tests that all root key IDs, but none of the bookkeeping
+// keys, are listed after several rotations.
+func TestListRootKeyIDs(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	ids, err := store.ListRootKeyIDs()
+	if err != nil {
+		t.Fatalf("Error listing root key IDs: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Expected no root key IDs, got %d", len(ids))
+	}
+
+	_, _, err = store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.RotateRootKey(); err != nil {
+			t.Fatalf("Error rotating root key: %v", err)
+		}
+	}
+
+	ids, err = store.ListRootKeyIDs()
+	if err != nil {
+		t.Fatalf("Error listing root key IDs: %v", err)
+	}
+
+	expectedIDs := map[string]bool{"0": true, "1": true, "2": true,
+		"3": true}
+	if len(ids) != len(expectedIDs) {
+		t.Fatalf("Expected %d root key IDs, got %d", len(expectedIDs),
+			len(ids))
+	}
+	for _, id := range ids {
+		if !expectedIDs[string(id)] {
+			t.Fatalf("Unexpected root key ID %s", string(id))
+		}
+	}
+}
+
+// TestDeleteRootKey tests that rotated out root keys can be deleted while the
+// active key and the encryption key are protected.
+func TestDeleteRootKey(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	err := store.DeleteRootKey([]byte("0"))
+	if err != macaroons.ErrStoreLocked {
+		t.Fatalf("Received %v instead of ErrStoreLocked", err)
+	}
+
+	pw := []byte("weks")
+	err = store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	_, oldID, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	newID, err := store.RotateRootKey()
+	if err != nil {
+		t.Fatalf("Error rotating root key: %v", err)
+	}
+
+	err = store.DeleteRootKey(newID)
+	if err != macaroons.ErrDeletingActiveKey {
+		t.Fatalf("Received %v instead of ErrDeletingActiveKey", err)
+	}
+
+	err = store.DeleteRootKey([]byte("enckey"))
+	if err == nil {
+		t.Fatalf("Deleting the encryption key should fail.")
+	}
+
+	err = store.DeleteRootKey(oldID)
+	if err != nil {
+		t.Fatalf("Error deleting root key: %v", err)
+	}
+
+	// Macaroons minted with the deleted key can't be verified anymore.
+	_, err = store.Get(nil, oldID)
+	if err == nil {
+		t.Fatalf("Getting a deleted root key should fail.")
+	}
+
+	err = store.DeleteRootKey(oldID)
+	if err == nil {
+		t.Fatalf("Deleting a non-existent root key should fail.")
+	}
+
+	ids, err := store.ListRootKeyIDs()
+	if err != nil {
+		t.Fatalf("Error listing root key IDs: %v", err)
+	}
+	if len(ids) != 1 || !bytes.Equal(ids[0], newID) {
+		t.Fatalf("Expected only root key %s to be left",
+			string(newID))
+	}
+}
+
+// TestDeleteRootKeyConcurrentGet tests that a root key that is being read by
+// Get while it's deleted doesn't end up in the cache, where it would keep
+// verifying macaroons minted with it.
+func TestDeleteRootKeyConcurrentGet(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		_, oldID, err := store.RootKey(nil)
+		if err != nil {
+			t.Fatalf("Error getting root key from store: %v", err)
+		}
+
+		// Rotating clears the cache, so the Get below has to read the
+		// old key from the database.
+		if _, err := store.RotateRootKey(); err != nil {
+			t.Fatalf("Error rotating root key: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Whether this finds the key depends on the order of
+			// events, so the result is ignored.
+			store.Get(nil, oldID)
+		}()
+
+		if err := store.DeleteRootKey(oldID); err != nil {
+			t.Fatalf("Error deleting root key: %v", err)
+		}
+		wg.Wait()
+
+		_, err = store.Get(nil, oldID)
+		if err == nil {
+			t.Fatalf("Deleted root key %s is still served",
+				string(oldID))
+		}
+	}
+}
+
+// TestCreateUnlockWithParams tests that a store created with custom scrypt
+// parameters can later be unlocked without supplying them again.
+func TestCreateUnlockWithParams(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	key, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	store = reopenStore(t, store, tempDir)
+	defer store.Close()
+
+	badpw := []byte("badweks")
+	err = store.CreateUnlock(&badpw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+
+	err = store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error unlocking root key store: %v", err)
+	}
+
+	key2, err := store.Get(nil, id)
+	if err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(id), err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Fatalf("Root key doesn't match: expected %v, got %v",
+			key, key2)
+	}
+}
+
+// TestChangePassword tests that changing the password re-encrypts every root
+// key, so macaroons minted under any historical key still verify.
+func TestChangePassword(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	newPw := []byte("newweks")
+	err := store.ChangePassword(&pw, &newPw)
+	if err != macaroons.ErrStoreLocked {
+		t.Fatalf("Received %v instead of ErrStoreLocked", err)
+	}
+
+	err = store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	// Mint a macaroon under the initial key and under two rotated keys.
+	var macs []*macaroon.Macaroon
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if _, err := store.RotateRootKey(); err != nil {
+				t.Fatalf("Error rotating root key: %v", err)
+			}
+		}
+
+		key, id, err := store.RootKey(nil)
+		if err != nil {
+			t.Fatalf("Error getting root key from store: %v", err)
+		}
+		mac, err := macaroon.New(key, id, "lnd",
+			macaroon.LatestVersion)
+		if err != nil {
+			t.Fatalf("Error creating macaroon: %v", err)
+		}
+		macs = append(macs, mac)
+	}
+
+	badpw := []byte("badweks")
+	err = store.ChangePassword(&badpw, &newPw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+
+	err = store.ChangePassword(&pw, &newPw)
+	if err != nil {
+		t.Fatalf("Error changing password: %v", err)
+	}
+
+	// Re-open the store and make sure only the new password unlocks it
+	// and all macaroons still verify.
+	store = reopenStore(t, store, tempDir)
+	defer store.Close()
+
+	err = store.CreateUnlock(&pw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+
+	err = store.CreateUnlock(&newPw)
+	if err != nil {
+		t.Fatalf("Error unlocking root key store: %v", err)
+	}
+
+	noCaveats := func(string) error { return nil }
+	for _, mac := range macs {
+		key, err := store.Get(nil, mac.Id())
+		if err != nil {
+			t.Fatalf("Error getting key with ID %s: %v",
+				string(mac.Id()), err)
+		}
+		if err := mac.Verify(key, noCaveats, nil); err != nil {
+			t.Fatalf("Error verifying macaroon with ID %s: %v",
+				string(mac.Id()), err)
+		}
+	}
+}
+
+// TestChangePasswordConfirmed tests that a password change only goes through
+// if the new password and its confirmation match.
+func TestChangePasswordConfirmed(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// Cheap scrypt parameters keep the repeated key derivations fast.
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	newPw := []byte("newweks")
+	typo := []byte("newwkes")
+	err = store.ChangePasswordConfirmed(&pw, &newPw, &typo)
+	if err != macaroons.ErrPasswordMismatch {
+		t.Fatalf("Received %v instead of ErrPasswordMismatch", err)
+	}
+
+	// The mismatch must have left the old password in place.
+	err = store.ChangePasswordConfirmed(&newPw, &pw, &pw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+
+	newPwConfirm := []byte("newweks")
+	err = store.ChangePasswordConfirmed(&pw, &newPw, &newPwConfirm)
+	if err != nil {
+		t.Fatalf("Error changing password: %v", err)
+	}
+
+	err = store.ChangePasswordConfirmed(&pw, &pw, &pw)
+	if err != snacl.ErrInvalidPassword {
+		t.Fatalf("Received %v instead of ErrInvalidPassword", err)
+	}
+}
+
+// TestChangePasswordConcurrentGet tests that root keys can be retrieved
+// without errors while the password is being changed.
+func TestChangePasswordConcurrentGet(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	key, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	quit := make(chan struct{})
+	getErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-quit:
+				getErr <- nil
+				return
+			default:
+			}
+
+			key2, err := store.Get(nil, id)
+			if err != nil {
+				getErr <- err
+				return
+			}
+			if !bytes.Equal(key, key2) {
+				getErr <- fmt.Errorf("root key doesn't match: "+
+					"expected %v, got %v", key, key2)
+				return
+			}
+		}
+	}()
+
+	// Every password change clears the cache, so the goroutine above
+	// keeps decrypting from the database while the keys are swapped.
+	passwords := [][]byte{pw, []byte("newweks")}
+	for i := 0; i < 20; i++ {
+		oldPw := passwords[i%2]
+		newPw := passwords[(i+1)%2]
+		if err := store.ChangePassword(&oldPw, &newPw); err != nil {
+			close(quit)
+			t.Fatalf("Error changing password: %v", err)
+		}
+	}
+	close(quit)
+
+	if err := <-getErr; err != nil {
+		t.Fatalf("Error getting key with ID %s: %v", string(id), err)
+	}
+}
+
+// TestStoreGetReturnsCopy tests that modifying a returned root key doesn't
+// affect the keys cached by the store.
+func TestStoreGetReturnsCopy(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	err := store.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	key, id, err := store.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from store: %v", err)
+	}
+	expectedKey := make([]byte, len(key))
+	copy(expectedKey, key)
+
+	for i := 0; i < 2; i++ {
+		for j := range key {
+			key[j] = 0
+		}
+
+		key, err = store.Get(nil, id)
+		if err != nil {
+			t.Fatalf("Error getting key with ID %s: %v",
+				string(id), err)
+		}
+		if !bytes.Equal(key, expectedKey) {
+			t.Fatalf("Root key doesn't match: expected %v, got %v",
+				expectedKey, key)
+		}
+	}
+}
+
+// BenchmarkStoreGet benchmarks retrieving a root key, as done for every
+// macaroon that is verified.
+func BenchmarkStoreGet(b *testing.B) {
+	store, _, cleanup := newTestStore(b)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		b.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	_, id, err := store.RootKey(nil)
+	if err != nil {
+		b.Fatalf("Error getting root key from store: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Get(nil, id); err != nil {
+			b.Fatalf("Error getting key with ID %s: %v",
+				string(id), err)
+		}
+	}
+}
+
+// TestRestoreFromBackup tests that a backup taken while keys are being
+// rotated restores to a consistent store that unlocks with the same password,
+// and that the backup file itself isn't modified by using the restored store.
+func TestRestoreFromBackup(t *testing.T) {
+	store, tempDir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pw := []byte("weks")
+	params := macaroons.ScryptParams{N: 16, R: 8, P: 1}
+	err := store.CreateUnlockWithParams(&pw, params)
+	if err != nil {
+		t.Fatalf("Error creating store encryption key: %v", err)
+	}
+
+	// Keep rotating and minting while the backup is taken.
+	rotateErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := store.RotateRootKey(); err != nil {
+				rotateErr <- err
+				return
+			}
+			if _, _, err := store.RootKey(nil); err != nil {
+				rotateErr <- err
+				return
+			}
+		}
+		rotateErr <- nil
+	}()
+
+	backupPath := path.Join(tempDir, "backup.db")
+	backupFile, err := os.Create(backupPath)
+	if err != nil {
+		t.Fatalf("Error creating backup file: %v", err)
+	}
+	err = store.Backup(backupFile)
+	backupFile.Close()
+	if err != nil {
+		t.Fatalf("Error backing up store: %v", err)
+	}
+
+	if err := <-rotateErr; err != nil {
+		t.Fatalf("Error rotating root key: %v", err)
+	}
+
+	backup, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("Error reading backup file: %v", err)
+	}
+
+	restorePath := path.Join(tempDir, "restored.db")
+	restoredStore, err := macaroons.RestoreFromBackup(
+		backupPath, restorePath,
+	)
+	if err != nil {
+		t.Fatalf("Error restoring backup: %v", err)
+	}
+	defer restoredStore.Close()
+
+	// An existing file at the destination is never overwritten.
+	_, err = macaroons.RestoreFromBackup(backupPath, restorePath)
+	if err == nil {
+		t.Fatalf("Restoring over an existing file should fail.")
+	}
+
+	_, _, err = restoredStore.RootKey(nil)
+	if err != macaroons.ErrStoreLocked {
+		t.Fatalf("Received %v instead of ErrStoreLocked", err)
+	}
+
+	err = restoredStore.CreateUnlock(&pw)
+	if err != nil {
+		t.Fatalf("Error unlocking restored store: %v", err)
+	}
+
+	// Every key in the snapshot must decrypt and match the original.
+	ids, err := restoredStore.ListRootKeyIDs()
+	if err != nil {
+		t.Fatalf("Error listing root key IDs: %v", err)
+	}
+	for _, id := range ids {
+		key, err := restoredStore.Get(nil, id)
+		if err != nil {
+			t.Fatalf("Error getting key with ID %s: %v",
+				string(id), err)
+		}
+		key2, err := store.Get(nil, id)
+		if err != nil {
+			t.Fatalf("Error getting key with ID %s: %v",
+				string(id), err)
+		}
+		if !bytes.Equal(key, key2) {
+			t.Fatalf("Root key doesn't match: expected %v, got %v",
+				key2, key)
+		}
+	}
+
+	_, _, err = restoredStore.RootKey(nil)
+	if err != nil {
+		t.Fatalf("Error getting root key from restored store: %v", err)
+	}
+	if _, err := restoredStore.RotateRootKey(); err != nil {
+		t.Fatalf("Error rotating root key: %v", err)
+	}
+
+	// Using the restored store must leave the backup untouched.
+	backup2, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("Error reading backup file: %v", err)
+	}
+	if !bytes.Equal(backup, backup2) {
+		t.Fatalf("Backup file changed by using the restored store")
+	}
+}